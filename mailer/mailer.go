@@ -11,12 +11,39 @@
 package mailer
 
 import (
+	"bytes"
 	"fmt"
-	"strings"
 	"github.com/mailgun/mailgun-go"
-	"github.com/writefreely/writefreely/config"
 	"github.com/writeas/web-core/log"
+	"github.com/writefreely/writefreely/config"
 	mail "github.com/xhit/go-simple-mail/v2"
+	"html"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultQueueConcurrency is the number of workers draining the send
+	// queue when config.EmailCfg.QueueConcurrency isn't set.
+	defaultQueueConcurrency = 4
+	// defaultMaxSendAttempts is the number of delivery attempts, the first
+	// one included, made for a queued message before it's written to the
+	// dead-letter log.
+	defaultMaxSendAttempts = 5
+	// queueCapacity bounds how many messages can be buffered awaiting a
+	// free worker before Enqueue blocks.
+	queueCapacity = 1000
+	// mailgunMaxRecipientsPerRequest is Mailgun's documented limit on
+	// recipient-variables batching for a single API call.
+	mailgunMaxRecipientsPerRequest = 1000
 )
 
 type (
@@ -24,26 +51,85 @@ type (
 	Mailer struct {
 		smtp    *mail.SMTPServer
 		mailGun *mailgun.MailgunImpl
+		devDir  string
+
+		queue     chan *queuedMessage
+		queueWG   sync.WaitGroup
+		closeOnce sync.Once
+		// queueMu guards every send on queue: Enqueue and retryOrDeadLetter's
+		// retry timer take it for reading, Close takes it for writing, so
+		// close(queue) can never race with a concurrent send.
+		queueMu         sync.RWMutex
+		closed          bool
+		maxSendAttempts int
+		deadLetterPath  string
+	}
+
+	// queuedMessage tracks a Message submitted via Mailer.Enqueue along
+	// with how many times delivery has been attempted.
+	queuedMessage struct {
+		msg      *Message
+		attempts int
 	}
 
 	// Message holds the email contents and metadata for the preferred mailing provider.
 	Message struct {
 		mgMsg   *mailgun.Message
 		smtpMsg *SmtpMessage
+
+		html         string
+		textExplicit bool
+		autoText     bool
+
+		// recipients mirrors every recipient added via NewMessage or
+		// AddRecipientAndVariables, regardless of backend, so SendBatch
+		// can report per-recipient errors even for Mailgun messages.
+		recipients []string
+
+		// pendingMailgun holds everything needed to build mgMsg once its
+		// text body is known. It's only set when the Mailgun backend is
+		// in use and NewMessage was called without an explicit text
+		// body, so construction must wait for SetHTML/AutoText to
+		// derive (or confirm) the text/plain alternative.
+		pendingMailgun *pendingMailgunMessage
+	}
+
+	// pendingMailgunMessage buffers the calls made on a Message before
+	// its underlying mailgun.Message can be constructed.
+	pendingMailgunMessage struct {
+		mailGun       *mailgun.MailgunImpl
+		from, subject string
+		to            []string
+		replyTo       string
+		tags          []string
+		recipientVars map[string]map[string]interface{}
+		attachments   []Attachment
+		inlines       []Attachment
 	}
 
 	SmtpMessage struct {
-		from string
-		replyTo string 
-		subject string
-		recipients []Recipient
-		html string
-		text string
+		from        string
+		replyTo     string
+		subject     string
+		recipients  []Recipient
+		html        string
+		text        string
+		attachments []Attachment
 	}
 
 	Recipient struct {
 		email string
-		vars map[string]string
+		vars  map[string]string
+	}
+
+	// Attachment holds a file to be sent alongside a Message, either as a
+	// regular attachment or, when cid is set, as an inline image. cid only
+	// marks the file as inline; it is not sent as the part's Content-ID.
+	Attachment struct {
+		filename    string
+		data        []byte
+		contentType string
+		cid         string
 	}
 )
 
@@ -52,6 +138,12 @@ func New(eCfg config.EmailCfg) (*Mailer, error) {
 	m := &Mailer{}
 	if eCfg.Domain != "" && eCfg.MailgunPrivate != "" {
 		m.mailGun = mailgun.NewMailgun(eCfg.Domain, eCfg.MailgunPrivate)
+	} else if eCfg.Outgoing != "" {
+		smtp, err := parseOutgoingURL(eCfg.Outgoing)
+		if err != nil {
+			return nil, err
+		}
+		m.smtp = smtp
 	} else if eCfg.Username != "" && eCfg.Password != "" && eCfg.Host != "" && eCfg.Port > 0 {
 		m.smtp = mail.NewSMTPClient()
 		m.smtp.Host = eCfg.Host
@@ -63,46 +155,308 @@ func New(eCfg config.EmailCfg) (*Mailer, error) {
 		}
 		// To allow sending multiple email
 		m.smtp.KeepAlive = true
+	} else if eCfg.Type == "dev" || eCfg.DevDir != "" {
+		devDir := eCfg.DevDir
+		if devDir == "" {
+			devDir = filepath.Join(os.TempDir(), "writefreely-mail")
+		}
+		if err := os.MkdirAll(devDir, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create dev mail directory %s: %v", devDir, err)
+		}
+		m.devDir = devDir
+		log.Info("mailer: using dev mail backend, writing messages to %s", devDir)
 	} else {
 		return nil, fmt.Errorf("no email provider is configured")
 	}
 
+	concurrency := eCfg.QueueConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultQueueConcurrency
+	}
+	m.maxSendAttempts = eCfg.MaxSendAttempts
+	if m.maxSendAttempts <= 0 {
+		m.maxSendAttempts = defaultMaxSendAttempts
+	}
+	m.deadLetterPath = eCfg.DeadLetterPath
+	if m.deadLetterPath == "" {
+		m.deadLetterPath = filepath.Join(os.TempDir(), "writefreely-mail-deadletter.log")
+	}
+	m.startWorkers(concurrency)
+
 	return m, nil
 }
 
+// startWorkers initializes the send queue and launches n worker
+// goroutines to drain it.
+func (m *Mailer) startWorkers(n int) {
+	m.queue = make(chan *queuedMessage, queueCapacity)
+	for i := 0; i < n; i++ {
+		m.queueWG.Add(1)
+		go m.worker()
+	}
+}
+
+// Enqueue submits msg to the Mailer's background send queue and returns
+// without waiting for a provider round-trip; it blocks only while the
+// queue's buffer of queueCapacity messages is full. Transient
+// failures are retried with exponential backoff, up to maxSendAttempts,
+// before being recorded in the dead-letter log.
+func (m *Mailer) Enqueue(msg *Message) {
+	m.queueMu.RLock()
+	defer m.queueMu.RUnlock()
+	if m.closed {
+		log.Error("mailer: Enqueue called after Close; dropping message")
+		return
+	}
+	m.queue <- &queuedMessage{msg: msg}
+}
+
+// Close stops accepting new work on the send queue and blocks until the
+// workers have drained every message already in the queue. It does not
+// wait for messages awaiting a retry backoff: those, and any message
+// that fails during the drain, are written to the dead-letter log when
+// their backoff elapses, which can be after Close returns.
+func (m *Mailer) Close() {
+	m.closeOnce.Do(func() {
+		m.queueMu.Lock()
+		m.closed = true
+		close(m.queue)
+		m.queueMu.Unlock()
+	})
+	m.queueWG.Wait()
+}
+
+func (m *Mailer) worker() {
+	defer m.queueWG.Done()
+	for qm := range m.queue {
+		if err := m.Send(qm.msg); err != nil {
+			m.retryOrDeadLetter(qm, err)
+		}
+	}
+}
+
+// retryOrDeadLetter schedules qm for another attempt after an
+// exponential backoff, or writes it to the dead-letter log once
+// maxSendAttempts is exhausted or the Mailer is shutting down.
+func (m *Mailer) retryOrDeadLetter(qm *queuedMessage, sendErr error) {
+	qm.attempts++
+	if qm.attempts >= m.maxSendAttempts {
+		m.logDeadLetter(qm, sendErr)
+		return
+	}
+	backoff := time.Duration(math.Pow(2, float64(qm.attempts))) * time.Second
+	log.Info("mailer: retrying message (attempt %d) in %s after error: %v", qm.attempts+1, backoff, sendErr)
+	time.AfterFunc(backoff, func() {
+		m.queueMu.RLock()
+		defer m.queueMu.RUnlock()
+		if m.closed {
+			m.logDeadLetter(qm, sendErr)
+			return
+		}
+		m.queue <- qm
+	})
+}
+
+// logDeadLetter records a message that could not be delivered, either
+// after exhausting its retry attempts or because the Mailer was closed
+// before its next retry.
+func (m *Mailer) logDeadLetter(qm *queuedMessage, sendErr error) {
+	log.Error("mailer: giving up on message after %d attempts: %v", qm.attempts, sendErr)
+	f, err := os.OpenFile(m.deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Error("mailer: unable to open dead-letter log %s: %v", m.deadLetterPath, err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s\tattempts=%d\terror=%v\n", time.Now().Format(time.RFC3339), qm.attempts, sendErr)
+}
+
+// parseOutgoingURL builds an *mail.SMTPServer from a URL of the form
+// `smtp[s][+mechanism][+starttls]://user:pass@host:port`, where mechanism
+// is one of plain, login, cram-md5, or none (anonymous). This lets
+// operators configure outgoing mail with a single, portable string
+// instead of a handful of discrete Host/Port/Username/Password fields.
+func parseOutgoingURL(outgoing string) (*mail.SMTPServer, error) {
+	u, err := url.Parse(outgoing)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outgoing mail URL: %v", err)
+	}
+
+	parts := strings.Split(u.Scheme, "+")
+	if len(parts) == 0 || (parts[0] != "smtp" && parts[0] != "smtps") {
+		return nil, fmt.Errorf("invalid outgoing mail URL scheme %q: must be smtp or smtps", u.Scheme)
+	}
+	implicitTLS := parts[0] == "smtps"
+
+	starttls := false
+	auth := mail.AuthPlain
+	for _, suffix := range parts[1:] {
+		switch suffix {
+		case "starttls":
+			starttls = true
+		case "plain":
+			auth = mail.AuthPlain
+		case "login":
+			auth = mail.AuthLogin
+		case "cram-md5":
+			auth = mail.AuthCRAMMD5
+		case "none":
+			auth = mail.AuthNone
+		default:
+			return nil, fmt.Errorf("invalid outgoing mail URL scheme suffix %q", suffix)
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		// no explicit port; fall back to the standard SMTP/SMTPS port
+		host = u.Host
+		if implicitTLS {
+			portStr = "465"
+		} else {
+			portStr = "587"
+		}
+	}
+	port := 0
+	if _, err := fmt.Sscanf(portStr, "%d", &port); err != nil {
+		return nil, fmt.Errorf("invalid port in outgoing mail URL: %v", err)
+	}
+
+	smtp := mail.NewSMTPClient()
+	smtp.Host = host
+	smtp.Port = port
+	smtp.Authentication = auth
+	if u.User != nil {
+		smtp.Username = u.User.Username()
+		smtp.Password, _ = u.User.Password()
+	}
+	if implicitTLS {
+		smtp.Encryption = mail.EncryptionSSLTLS
+	} else if starttls {
+		smtp.Encryption = mail.EncryptionSTARTTLS
+	}
+	// To allow sending multiple email
+	smtp.KeepAlive = true
+
+	return smtp, nil
+}
+
 // NewMessage creates a new Message from the given parameters.
 func (m *Mailer) NewMessage(from, subject, text string, to ...string) (*Message, error) {
 	msg := &Message{}
 	if m.mailGun != nil {
-		msg.mgMsg = m.mailGun.NewMessage(from, subject, text, to...)
-	} else if m.smtp != nil {
-		msg.smtpMsg = &SmtpMessage {
-			from,
-			"",
-			subject,
-			make([]Recipient, len(to)),
-			"",
-			text,
+		if text != "" {
+			msg.mgMsg = m.mailGun.NewMessage(from, subject, text, to...)
+		} else {
+			// mailgun.Message takes its text body at construction time,
+			// with no later setter. Defer building it until SetHTML or
+			// AutoText supplies the text/plain alternative.
+			msg.pendingMailgun = &pendingMailgunMessage{
+				mailGun: m.mailGun,
+				from:    from,
+				subject: subject,
+				to:      append([]string{}, to...),
+			}
+		}
+	} else if m.smtp != nil || m.devDir != "" {
+		msg.smtpMsg = &SmtpMessage{
+			from:       from,
+			subject:    subject,
+			recipients: make([]Recipient, 0, len(to)),
+			text:       text,
 		}
 		for _, r := range to {
 			msg.smtpMsg.recipients = append(msg.smtpMsg.recipients, Recipient{r, make(map[string]string)})
 		}
 	}
+	msg.textExplicit = text != ""
+	msg.recipients = append(msg.recipients, to...)
+	if m.mailGun != nil && len(to) > mailgunMaxRecipientsPerRequest {
+		log.Error("mailer: message to %d recipients exceeds Mailgun's %d-per-request limit; split into batches", len(to), mailgunMaxRecipientsPerRequest)
+	}
 	return msg, nil
 }
 
-// SetHTML sets the body of the message.
-func (m *Message) SetHTML(html string) {
+// SetHTML sets the body of the message. A text/plain alternative is
+// derived automatically from html unless the caller supplied an explicit
+// text body to NewMessage; after AutoText it is derived in either case
+// (see AutoText for the Mailgun exception).
+func (m *Message) SetHTML(htmlBody string) {
+	m.html = htmlBody
 	if m.smtpMsg != nil {
-		m.smtpMsg.html = html
+		m.smtpMsg.html = htmlBody
 	} else if m.mgMsg != nil {
-		m.mgMsg.SetHtml(html)
+		m.mgMsg.SetHtml(htmlBody)
+	}
+	if !m.textExplicit || m.autoText {
+		m.setTextFromHTML()
+	} else if m.pendingMailgun != nil {
+		// textExplicit with a still-pending message can't happen: NewMessage
+		// only defers construction when text was empty.
+		m.finalizeMailgun("")
+	}
+}
+
+// AutoText (re)derives the message's text/plain alternative from its
+// HTML body, overriding any text passed to NewMessage. For the Mailgun
+// backend this override only takes effect if NewMessage was called with
+// an empty text body; Mailgun has no setter for an already-built
+// message's text, so AutoText on a message constructed with explicit
+// text leaves that text unchanged there and only logs an error (see
+// setTextFromHTML).
+func (m *Message) AutoText() {
+	m.autoText = true
+	if m.html != "" {
+		m.setTextFromHTML()
+	}
+}
+
+func (m *Message) setTextFromHTML() {
+	text := htmlToText(m.html)
+	if m.smtpMsg != nil {
+		m.smtpMsg.text = text
+	} else if m.pendingMailgun != nil {
+		m.finalizeMailgun(text)
+	} else if m.mgMsg != nil {
+		// mailgun.Message has no setter for its text body once built;
+		// this only happens if AutoText() is called on a message that
+		// was given an explicit text at NewMessage time.
+		log.Error("mailer: cannot update the text/plain body of an already-built Mailgun message")
+	}
+}
+
+// finalizeMailgun builds mgMsg now that its text body is known, then
+// replays every call buffered in pendingMailgun while construction was
+// deferred.
+func (m *Message) finalizeMailgun(text string) {
+	p := m.pendingMailgun
+	m.mgMsg = p.mailGun.NewMessage(p.from, p.subject, text, p.to...)
+	m.pendingMailgun = nil
+	if m.html != "" {
+		m.mgMsg.SetHtml(m.html)
+	}
+	if p.replyTo != "" {
+		m.mgMsg.SetReplyTo(p.replyTo)
+	}
+	for _, tag := range p.tags {
+		m.mgMsg.AddTag(tag)
+	}
+	for email, vars := range p.recipientVars {
+		m.mgMsg.AddRecipientAndVariables(email, vars)
+	}
+	for _, a := range p.attachments {
+		m.mgMsg.AddBufferAttachment(a.filename, a.data)
+	}
+	for _, a := range p.inlines {
+		m.mgMsg.AddReaderInline(a.filename, io.NopCloser(bytes.NewReader(a.data)))
 	}
 }
 
 func (m *Message) SetReplyTo(replyTo string) {
-	if (m.smtpMsg != nil) {
+	if m.smtpMsg != nil {
 		m.smtpMsg.replyTo = replyTo
+	} else if m.pendingMailgun != nil {
+		m.pendingMailgun.replyTo = replyTo
 	} else {
 		m.mgMsg.SetReplyTo(replyTo)
 	}
@@ -110,69 +464,308 @@ func (m *Message) SetReplyTo(replyTo string) {
 
 // AddTag attaches a tag to the Message for providers that support it.
 func (m *Message) AddTag(tag string) {
-	if m.mgMsg != nil {
+	if m.pendingMailgun != nil {
+		m.pendingMailgun.tags = append(m.pendingMailgun.tags, tag)
+	} else if m.mgMsg != nil {
 		m.mgMsg.AddTag(tag)
 	}
 }
 
+// Attach adds a regular file attachment to the Message, uploaded as-is
+// alongside the email body. Works uniformly across the SMTP and Mailgun
+// backends.
+func (m *Message) Attach(filename string, data []byte, contentType string) error {
+	if m.smtpMsg != nil {
+		m.smtpMsg.attachments = append(m.smtpMsg.attachments, Attachment{filename: filename, data: data, contentType: contentType})
+		return nil
+	}
+	if m.pendingMailgun != nil {
+		m.pendingMailgun.attachments = append(m.pendingMailgun.attachments, Attachment{filename: filename, data: data, contentType: contentType})
+		return nil
+	}
+	m.mgMsg.AddBufferAttachment(filename, data)
+	return nil
+}
+
+// Embed adds data as an inline image, e.g. to embed a site logo in a
+// subscription email, on both the SMTP and Mailgun backends. cid only
+// marks the file as inline and is not sent as the part's Content-ID on
+// either backend: Mailgun identifies the inline file by filename
+// ("cid:<filename>"), and for SMTP the Content-ID is chosen by
+// go-simple-mail.
+func (m *Message) Embed(cid, filename string, data []byte, contentType string) error {
+	if m.smtpMsg != nil {
+		m.smtpMsg.attachments = append(m.smtpMsg.attachments, Attachment{filename: filename, data: data, contentType: contentType, cid: cid})
+		return nil
+	}
+	if m.pendingMailgun != nil {
+		m.pendingMailgun.inlines = append(m.pendingMailgun.inlines, Attachment{filename: filename, data: data, contentType: contentType, cid: cid})
+		return nil
+	}
+	// Mailgun references inline files from HTML as "cid:<filename>", so
+	// the filename doubles as the content ID. mailgun.Message has no
+	// buffer-based inline API, so wrap data in a no-op ReadCloser for
+	// AddReaderInline.
+	m.mgMsg.AddReaderInline(filename, io.NopCloser(bytes.NewReader(data)))
+	return nil
+}
+
 func (m *Message) AddRecipientAndVariables(r string, vars map[string]string) error {
+	m.recipients = append(m.recipients, r)
+	if len(m.recipients) > mailgunMaxRecipientsPerRequest {
+		log.Error("mailer: message now has %d recipients, exceeding Mailgun's %d-per-request limit; split into batches", len(m.recipients), mailgunMaxRecipientsPerRequest)
+	}
 	if m.smtpMsg != nil {
 		m.smtpMsg.recipients = append(m.smtpMsg.recipients, Recipient{r, vars})
 		return nil
-	} else {
-		varsInterfaces := make(map[string]interface{}, len(vars))
-		for k, v := range vars {
-			varsInterfaces[k] = v
+	}
+
+	varsInterfaces := make(map[string]interface{}, len(vars))
+	for k, v := range vars {
+		varsInterfaces[k] = v
+	}
+	if m.pendingMailgun != nil {
+		if m.pendingMailgun.recipientVars == nil {
+			m.pendingMailgun.recipientVars = make(map[string]map[string]interface{})
 		}
-		return m.mgMsg.AddRecipientAndVariables(r, varsInterfaces)
+		m.pendingMailgun.recipientVars[r] = varsInterfaces
+		return nil
 	}
+	return m.mgMsg.AddRecipientAndVariables(r, varsInterfaces)
 }
 
 // Send sends the given message via the preferred provider.
 func (m *Mailer) Send(msg *Message) error {
-	if m.smtp != nil {
+	if m.devDir != "" {
+		return m.sendDev(msg)
+	} else if m.smtp != nil {
 		client, err := m.smtp.Connect()
 		if err != nil {
 			return err
 		}
-		emailSent := false
-		for _, r := range msg.smtpMsg.recipients {
-			customMsg := mail.NewMSG()
-			customMsg.SetFrom(msg.smtpMsg.from)
-			if (msg.smtpMsg.replyTo != "") {
-				customMsg.SetReplyTo(msg.smtpMsg.replyTo)
+		sentAny, errs := m.sendSMTP(client, msg)
+		if !sentAny {
+			// only return an error if no email could be sent (to avoid retry of successfully sent emails)
+			for _, e := range errs {
+				return e
+			}
+		}
+	} else if m.mailGun != nil {
+		if msg.mgMsg == nil {
+			// SetHTML/AutoText was never called to supply a text body;
+			// finalize with whatever (possibly empty) text is known.
+			msg.finalizeMailgun("")
+		}
+		_, _, err := m.mailGun.Send(msg.mgMsg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// smtpRenderedGroup is a set of recipients who share an identical
+// rendered (html, text) body after %recipient.*% substitution, and so
+// can be BCC'd onto a single outgoing message.
+type smtpRenderedGroup struct {
+	recipients []string
+	html, text string
+}
+
+// groupRecipientsByRenderedBody substitutes each recipient's variables
+// into smtpMsg's html/text bodies and groups recipients whose rendered
+// output is identical, so sendSMTP can issue one DATA command per unique
+// body instead of one per recipient. The returned order preserves the
+// order groups were first seen.
+func groupRecipientsByRenderedBody(smtpMsg *SmtpMessage) (order []string, groups map[string]*smtpRenderedGroup) {
+	groups = make(map[string]*smtpRenderedGroup)
+	for _, r := range smtpMsg.recipients {
+		cText := smtpMsg.text
+		cHtml := smtpMsg.html
+		for v, value := range r.vars {
+			placeHolder := fmt.Sprintf("%%recipient.%s%%", v)
+			cText = strings.ReplaceAll(cText, placeHolder, value)
+			cHtml = strings.ReplaceAll(cHtml, placeHolder, value)
+		}
+		key := cHtml + "\x00" + cText
+		g, ok := groups[key]
+		if !ok {
+			g = &smtpRenderedGroup{html: cHtml, text: cText}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.recipients = append(g.recipients, r.email)
+	}
+	return order, groups
+}
+
+// sendSMTP renders msg's body once per unique combination of substituted
+// %recipient.*% variables and issues a single DATA command per group on
+// the given (already-connected, KeepAlive) client, instead of opening a
+// fresh message for every recipient. Recipients sharing a group are BCC'd
+// so they never see each other's address. It returns whether at least
+// one group was delivered, plus a per-recipient error for any that weren't.
+func (m *Mailer) sendSMTP(client *mail.SMTPClient, msg *Message) (sentAny bool, errs map[string]error) {
+	errs = make(map[string]error)
+
+	order, groups := groupRecipientsByRenderedBody(msg.smtpMsg)
+
+	for _, key := range order {
+		g := groups[key]
+		customMsg := mail.NewMSG()
+		customMsg.SetFrom(msg.smtpMsg.from)
+		if msg.smtpMsg.replyTo != "" {
+			customMsg.SetReplyTo(msg.smtpMsg.replyTo)
+		}
+		customMsg.SetSubject(msg.smtpMsg.subject)
+		// BCC the group so recipients who share a rendered body don't see
+		// each other's addresses in a visible To: header.
+		customMsg.AddTo(msg.smtpMsg.from)
+		for _, email := range g.recipients {
+			customMsg.AddBcc(email)
+		}
+		customMsg.SetBody(mail.TextHTML, g.html)
+		customMsg.AddAlternative(mail.TextPlain, g.text)
+		for _, a := range msg.smtpMsg.attachments {
+			file := &mail.File{Name: a.filename, MimeType: a.contentType, Data: a.data, Inline: a.cid != ""}
+			customMsg.Attach(file)
+		}
+		e := customMsg.Error
+		if e == nil {
+			e = customMsg.Send(client)
+		}
+		if e == nil {
+			sentAny = true
+		} else {
+			log.Error("Unable to send email to %v: %v", g.recipients, e)
+			for _, email := range g.recipients {
+				errs[email] = e
 			}
-			customMsg.SetSubject(msg.smtpMsg.subject)
-			customMsg.AddTo(r.email)
-			cText := msg.smtpMsg.text
-			cHtml := msg.smtpMsg.html
-			for v, value := range r.vars {
-				placeHolder := fmt.Sprintf("%%recipient.%s%%", v)
-				cText = strings.ReplaceAll(cText, placeHolder, value)
-				cHtml = strings.ReplaceAll(cHtml, placeHolder, value)
+		}
+	}
+	return sentAny, errs
+}
+
+// SendBatch sends every msgs entry via the preferred provider, reusing a
+// single SMTP connection across all of them, and returns a per-recipient
+// error for any delivery that failed so callers like subscription
+// broadcasts can retry only those recipients.
+func (m *Mailer) SendBatch(msgs []*Message) map[string]error {
+	errs := make(map[string]error)
+	if m.smtp != nil {
+		client, err := m.smtp.Connect()
+		if err != nil {
+			for _, msg := range msgs {
+				for _, email := range msg.recipients {
+					errs[email] = err
+				}
 			}
-			customMsg.SetBody(mail.TextHTML, cHtml)
-			customMsg.AddAlternative(mail.TextPlain, cText)
-			e := customMsg.Error
-			if e == nil {
-				e = customMsg.Send(client)
+			return errs
+		}
+		for _, msg := range msgs {
+			_, msgErrs := m.sendSMTP(client, msg)
+			for email, e := range msgErrs {
+				errs[email] = e
 			}
-			if e == nil {
-				emailSent = true
-			} else {
-				log.Error("Unable to send email to %s: %v",  r.email, e)
-				err = e
+		}
+		return errs
+	}
+
+	for _, msg := range msgs {
+		if err := m.Send(msg); err != nil {
+			for _, email := range msg.recipients {
+				errs[email] = err
 			}
 		}
-		if !emailSent {
-			// only send an error if no email could be sent (to avoid retry of successfully sent emails)
-			return err
+	}
+	return errs
+}
+
+// sendDev "sends" the given message by writing it to an .eml file in the
+// Mailer's devDir, so contributors can inspect outgoing mail without
+// configuring a real SMTP or Mailgun account.
+func (m *Mailer) sendDev(msg *Message) error {
+	for _, r := range msg.smtpMsg.recipients {
+		cText := msg.smtpMsg.text
+		cHtml := msg.smtpMsg.html
+		for v, value := range r.vars {
+			placeHolder := fmt.Sprintf("%%recipient.%s%%", v)
+			cText = strings.ReplaceAll(cText, placeHolder, value)
+			cHtml = strings.ReplaceAll(cHtml, placeHolder, value)
 		}
-	} else if m.mailGun != nil {
-		_, _, err := m.mailGun.Send(msg.mgMsg)
-		if err != nil {
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "From: %s\r\n", msg.smtpMsg.from)
+		fmt.Fprintf(&b, "To: %s\r\n", r.email)
+		if msg.smtpMsg.replyTo != "" {
+			fmt.Fprintf(&b, "Reply-To: %s\r\n", msg.smtpMsg.replyTo)
+		}
+		fmt.Fprintf(&b, "Subject: %s\r\n", msg.smtpMsg.subject)
+		fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+		for _, a := range msg.smtpMsg.attachments {
+			kind := "attachment"
+			if a.cid != "" {
+				kind = fmt.Sprintf("inline image (cid:%s)", a.cid)
+			}
+			fmt.Fprintf(&b, "X-WriteFreely-Dev-Attachment: %s %s (%s, %d bytes)\r\n", kind, a.filename, a.contentType, len(a.data))
+		}
+		b.WriteString("MIME-Version: 1.0\r\n")
+		boundary := "writefreely-dev-boundary"
+		fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+		if cText != "" {
+			fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n\r\n", boundary, cText)
+		}
+		if cHtml != "" {
+			fmt.Fprintf(&b, "--%s\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n%s\r\n\r\n", boundary, cHtml)
+		}
+		fmt.Fprintf(&b, "--%s--\r\n", boundary)
+
+		fileName := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(r.email, "/", "_"))
+		filePath := filepath.Join(m.devDir, fileName)
+		if err := os.WriteFile(filePath, []byte(b.String()), 0644); err != nil {
+			log.Error("Unable to write dev email for %s: %v", r.email, err)
 			return err
 		}
+		log.Info("mailer: wrote dev email for %s to %s", r.email, filePath)
 	}
 	return nil
 }
+
+var (
+	htmlLinkRe     = regexp.MustCompile(`(?is)<a\s+[^>]*href=["']([^"']*)["'][^>]*>(.*?)</a>`)
+	htmlHeaderRe   = regexp.MustCompile(`(?is)<h[1-6][^>]*>(.*?)</h[1-6]>`)
+	htmlListItemRe = regexp.MustCompile(`(?is)<li[^>]*>(.*?)</li>`)
+	htmlBreakRe    = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlBlockEndRe = regexp.MustCompile(`(?i)</(p|div|tr|table|ul|ol)>`)
+	htmlTagRe      = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankRunsRe    = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText derives a reasonable text/plain alternative from an HTML
+// email body: links become "text (url)", list items get a bullet,
+// headers are underlined, block elements become line breaks, and
+// entities are decoded. It's a lightweight approximation modeled on
+// html2text-style converters, not a full HTML parser.
+func htmlToText(input string) string {
+	out := htmlLinkRe.ReplaceAllString(input, "$2 ($1)")
+	out = htmlHeaderRe.ReplaceAllStringFunc(out, func(match string) string {
+		text := strings.TrimSpace(stripTags(htmlHeaderRe.FindStringSubmatch(match)[1]))
+		return "\n" + text + "\n" + strings.Repeat("-", len(text)) + "\n"
+	})
+	out = htmlListItemRe.ReplaceAllString(out, "  * $1\n")
+	out = htmlBreakRe.ReplaceAllString(out, "\n")
+	out = htmlBlockEndRe.ReplaceAllString(out, "\n")
+	out = stripTags(out)
+	out = html.UnescapeString(out)
+
+	lines := strings.Split(out, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	out = blankRunsRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(out) + "\n"
+}
+
+func stripTags(s string) string {
+	return htmlTagRe.ReplaceAllString(s, "")
+}